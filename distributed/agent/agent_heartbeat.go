@@ -0,0 +1,184 @@
+package agent
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"time"
+
+	pb "github.com/chrislusf/gleam/idl/master_rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	defaultHeartbeatInterval    = 5 * time.Second
+	defaultGrpcKeepaliveTime    = 30 * time.Second
+	defaultGrpcKeepaliveTimeout = 10 * time.Second
+	defaultMaxReconnectAttempts = 12
+	maxReconnectBackoff         = time.Minute
+)
+
+// heartbeat owns the agent's single long-lived connection to master: dial,
+// stream heartbeats, and on any error redial with jittered, capped backoff.
+// attempts tracks a run of *consecutive* failures and resets the moment a
+// session connects again, so a long-running agent that hits one transient
+// blip a month doesn't slowly ratchet toward giving up — only
+// maxReconnectAttempts failures in a row, with no successful reconnect in
+// between, trips giveUp.
+func (as *AgentServer) heartbeat() {
+	attempts := 0
+	for !as.isStopped() {
+		err := as.runHeartbeatSession(func() { attempts = 0 })
+		if as.isStopped() {
+			return
+		}
+		if err == nil {
+			continue
+		}
+
+		attempts++
+		fmt.Printf("heartbeat to master %s failed: %v (attempt %d/%d)\n",
+			as.Master, err, attempts, as.maxReconnectAttempts())
+
+		if attempts >= as.maxReconnectAttempts() {
+			fmt.Printf("could not reach master %s after %d attempts, giving up\n", as.Master, attempts)
+			as.giveUp()
+			return
+		}
+
+		time.Sleep(reconnectBackoff(attempts))
+	}
+}
+
+// runHeartbeatSession dials master once and streams heartbeats until the
+// stream errors out or the agent is asked to stop. onConnected is called
+// once the stream is up, before the first Send, so the caller can treat the
+// reconnect as successful even if the stream later drops again.
+func (as *AgentServer) runHeartbeatSession(onConnected func()) error {
+	conn, err := grpc.Dial(as.Master,
+		grpc.WithInsecure(),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                as.grpcKeepaliveTime(),
+			Timeout:             as.grpcKeepaliveTimeout(),
+			PermitWithoutStream: as.grpcKeepalivePermitWithoutStream(),
+		}),
+	)
+	if err != nil {
+		return err
+	}
+	as.setGrpcConnection(conn)
+	defer as.setGrpcConnection(nil)
+	defer conn.Close()
+
+	client := pb.NewGleamMasterClient(conn)
+	stream, err := client.SendHeartbeat(context.Background())
+	if err != nil {
+		return err
+	}
+	onConnected()
+
+	for {
+		if as.isStopped() {
+			return nil
+		}
+
+		as.allocatedResourceLock.Lock()
+		allocated := as.allocatedResource
+		as.allocatedResourceLock.Unlock()
+
+		err := stream.Send(&pb.Heartbeat{
+			Host:                 *as.Option.Host,
+			Port:                 int32(*as.Option.Port),
+			ComputeResource:      as.computeResource,
+			AllocatedResource:    allocated,
+			ClusterConfigVersion: as.getClusterConfigVersion(),
+		})
+		if err != nil {
+			return err
+		}
+
+		resp, err := stream.Recv()
+		if err != nil {
+			return err
+		}
+		as.setClusterConfigVersion(resp.GetClusterConfigVersion())
+
+		time.Sleep(defaultHeartbeatInterval)
+	}
+}
+
+// giveUp is reached once the agent has failed to reconnect to master
+// maxReconnectAttempts times in a row. It makes a best-effort attempt to
+// deregister — master may well be the thing that's unreachable, so errors
+// here are not worth retrying — then stops the accept loop and terminates
+// the process, leaving the decision of whether to restart to whatever is
+// supervising it.
+func (as *AgentServer) giveUp() {
+	as.deregister()
+	as.Stop()
+	os.Exit(1)
+}
+
+func (as *AgentServer) deregister() {
+	conn, err := grpc.Dial(as.Master, grpc.WithInsecure())
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	pb.NewGleamMasterClient(conn).DeregisterAgent(ctx, &pb.DeregisterAgentRequest{AgentUuid: as.agentUUID})
+}
+
+func (as *AgentServer) setGrpcConnection(conn *grpc.ClientConn) {
+	as.grpcConectionLock.Lock()
+	defer as.grpcConectionLock.Unlock()
+	as.grpcConection = conn
+}
+
+// reconnectBackoff is a jittered exponential backoff, doubling per attempt
+// and capped at maxReconnectBackoff, so repeated reconnect attempts don't
+// hammer a master that is still recovering.
+func reconnectBackoff(attempt int) time.Duration {
+	backoff := time.Second
+	for i := 0; i < attempt && backoff < maxReconnectBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxReconnectBackoff {
+		backoff = maxReconnectBackoff
+	}
+	jitter := time.Duration(rand.Int63n(int64(backoff) / 2))
+	return backoff/2 + jitter
+}
+
+func (as *AgentServer) grpcKeepaliveTime() time.Duration {
+	if as.Option.GrpcKeepaliveTime != nil {
+		return *as.Option.GrpcKeepaliveTime
+	}
+	return defaultGrpcKeepaliveTime
+}
+
+func (as *AgentServer) grpcKeepaliveTimeout() time.Duration {
+	if as.Option.GrpcKeepaliveTimeout != nil {
+		return *as.Option.GrpcKeepaliveTimeout
+	}
+	return defaultGrpcKeepaliveTimeout
+}
+
+func (as *AgentServer) grpcKeepalivePermitWithoutStream() bool {
+	if as.Option.GrpcKeepalivePermitWithoutStream != nil {
+		return *as.Option.GrpcKeepalivePermitWithoutStream
+	}
+	return true
+}
+
+func (as *AgentServer) maxReconnectAttempts() int {
+	if as.Option.MaxReconnectAttempts != nil {
+		return *as.Option.MaxReconnectAttempts
+	}
+	return defaultMaxReconnectAttempts
+}
@@ -0,0 +1,35 @@
+package agent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconnectBackoffCapsAtMax(t *testing.T) {
+	for attempt := 1; attempt <= 20; attempt++ {
+		backoff := reconnectBackoff(attempt)
+		if backoff <= 0 {
+			t.Fatalf("attempt %d: backoff should be positive, got %v", attempt, backoff)
+		}
+		if backoff > maxReconnectBackoff {
+			t.Fatalf("attempt %d: backoff %v exceeds cap %v", attempt, backoff, maxReconnectBackoff)
+		}
+	}
+}
+
+func TestReconnectBackoffGrowsWithAttempts(t *testing.T) {
+	// Backoff is jittered: reconnectBackoff(attempt) returns a value
+	// uniformly in [backoff/2, backoff), where backoff doubles per attempt
+	// up to maxReconnectBackoff. attempt 1 doubles once (1s -> 2s), so its
+	// range is [1s, 2s); compare that against attempt 10's minimum possible
+	// value, which should already be at or near the cap.
+	small := reconnectBackoff(1)
+	if small < time.Second || small >= 2*time.Second {
+		t.Fatalf("attempt 1 backoff should be in [1s, 2s), got %v", small)
+	}
+
+	large := reconnectBackoff(10)
+	if large < maxReconnectBackoff/2 {
+		t.Fatalf("attempt 10 backoff should be near the cap, got %v", large)
+	}
+}
@@ -0,0 +1,159 @@
+package agent
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	pb "github.com/chrislusf/gleam/idl/master_rpc"
+	"google.golang.org/grpc"
+)
+
+const (
+	agentIdentityFileName     = "agent.uuid"
+	defaultRegisterMaxRetries = 5
+	defaultRegisterBackoff    = 2 * time.Second
+)
+
+// Register attempts a RegisterAgent RPC against master, carrying the
+// agent's compute resource, data center, rack, and a persisted identity,
+// retrying with linear backoff until it succeeds or runs out of attempts.
+// It must be called after net.Listen has claimed the agent's port, since
+// master will start routing work to it as soon as registration succeeds.
+//
+// The agent UUID is loaded from (or created under) Option.Dir and survives
+// restarts, with a monotonically increasing epoch bumped on every load. An
+// epoch greater than 1 means this is the same agent coming back up rather
+// than a fresh one, so its previously-allocated shards on disk are
+// reclaimed via storageBackend.reclaim() instead of being left for
+// purgeExpiredEntries to sweep up as orphans before a reader reconnects.
+func (as *AgentServer) Register(ctx context.Context) error {
+	uuid, epoch, err := as.loadOrCreateIdentity()
+	if err != nil {
+		return err
+	}
+	as.agentUUID = uuid
+	as.agentEpoch = epoch
+
+	if epoch > 1 {
+		if err := as.storageBackend.reclaim(); err != nil {
+			fmt.Printf("failed to reclaim on-disk shards for agent %s: %v\n", uuid, err)
+		}
+	}
+
+	maxRetries := as.registerMaxRetries()
+	var lastErr error
+	for attempt := 1; attempt <= maxRetries; attempt++ {
+		resp, err := as.registerOnce(ctx)
+		if err == nil {
+			as.setClusterConfigVersion(resp.GetClusterConfigVersion())
+			return nil
+		}
+		lastErr = err
+		fmt.Printf("register with master %s failed: %v (attempt %d/%d)\n", as.Master, err, attempt, maxRetries)
+		if attempt < maxRetries {
+			time.Sleep(as.registerBackoff() * time.Duration(attempt))
+		}
+	}
+	return fmt.Errorf("failed to register with master %s after %d attempts: %v", as.Master, maxRetries, lastErr)
+}
+
+func (as *AgentServer) registerOnce(ctx context.Context) (*pb.RegisterAgentResponse, error) {
+	conn, err := grpc.Dial(as.Master, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := pb.NewGleamMasterClient(conn)
+	return client.RegisterAgent(ctx, &pb.RegisterAgentRequest{
+		AgentUuid:       as.agentUUID,
+		Epoch:           as.agentEpoch,
+		Host:            *as.Option.Host,
+		Port:            int32(*as.Option.Port),
+		DataCenter:      *as.Option.DataCenter,
+		Rack:            *as.Option.Rack,
+		ComputeResource: as.computeResource,
+	})
+}
+
+// setClusterConfigVersion adopts v if it is newer than what the agent has
+// already seen, and triggers localExecutorManager to refresh its policies
+// (e.g. MaxExecutor, memory caps) so a cluster-config change takes effect
+// without restarting the agent.
+func (as *AgentServer) setClusterConfigVersion(v uint64) {
+	as.clusterConfigVersionLock.Lock()
+	defer as.clusterConfigVersionLock.Unlock()
+	if v <= as.clusterConfigVersion {
+		return
+	}
+	as.clusterConfigVersion = v
+	as.localExecutorManager.RefreshPolicy(*as.Option.MaxExecutor, *as.Option.MemoryMB)
+}
+
+func (as *AgentServer) getClusterConfigVersion() uint64 {
+	as.clusterConfigVersionLock.Lock()
+	defer as.clusterConfigVersionLock.Unlock()
+	return as.clusterConfigVersion
+}
+
+func (as *AgentServer) identityPath() string {
+	return filepath.Join(*as.Option.Dir, agentIdentityFileName)
+}
+
+// loadOrCreateIdentity reads the agent's persisted UUID and epoch from
+// Option.Dir, bumping the epoch by one, or creates a fresh identity with
+// epoch 1 if none is on disk yet.
+func (as *AgentServer) loadOrCreateIdentity() (uuid string, epoch uint64, err error) {
+	if data, err := ioutil.ReadFile(as.identityPath()); err == nil {
+		lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+		if len(lines) == 2 {
+			if parsedEpoch, err := strconv.ParseUint(lines[1], 10, 64); err == nil {
+				uuid = lines[0]
+				epoch = parsedEpoch + 1
+				return uuid, epoch, as.persistIdentity(uuid, epoch)
+			}
+		}
+	}
+
+	uuid, err = generateUUID()
+	if err != nil {
+		return "", 0, err
+	}
+	epoch = 1
+	return uuid, epoch, as.persistIdentity(uuid, epoch)
+}
+
+func (as *AgentServer) persistIdentity(uuid string, epoch uint64) error {
+	content := fmt.Sprintf("%s\n%d\n", uuid, epoch)
+	return ioutil.WriteFile(as.identityPath(), []byte(content), 0644)
+}
+
+func generateUUID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func (as *AgentServer) registerMaxRetries() int {
+	if as.Option.RegisterMaxRetries != nil {
+		return *as.Option.RegisterMaxRetries
+	}
+	return defaultRegisterMaxRetries
+}
+
+func (as *AgentServer) registerBackoff() time.Duration {
+	if as.Option.RegisterBackoff != nil {
+		return *as.Option.RegisterBackoff
+	}
+	return defaultRegisterBackoff
+}
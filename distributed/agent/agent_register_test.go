@@ -0,0 +1,56 @@
+package agent
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func newTestAgentServerForIdentity(t *testing.T, dir string) *AgentServer {
+	t.Helper()
+	return &AgentServer{Option: &AgentServerOption{Dir: &dir}}
+}
+
+func TestLoadOrCreateIdentityBumpsEpochAcrossRestarts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "agent-identity-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	as := newTestAgentServerForIdentity(t, dir)
+
+	uuid1, epoch1, err := as.loadOrCreateIdentity()
+	if err != nil {
+		t.Fatalf("first loadOrCreateIdentity failed: %v", err)
+	}
+	if epoch1 != 1 {
+		t.Fatalf("expected epoch 1 on first run, got %d", epoch1)
+	}
+	if uuid1 == "" {
+		t.Fatal("expected a non-empty uuid")
+	}
+
+	uuid2, epoch2, err := as.loadOrCreateIdentity()
+	if err != nil {
+		t.Fatalf("second loadOrCreateIdentity failed: %v", err)
+	}
+	if uuid2 != uuid1 {
+		t.Fatalf("expected uuid to survive restart, got %q want %q", uuid2, uuid1)
+	}
+	if epoch2 != epoch1+1 {
+		t.Fatalf("expected epoch to bump to %d, got %d", epoch1+1, epoch2)
+	}
+}
+
+func TestRegisterMaxRetriesAndBackoffDefaults(t *testing.T) {
+	dir := "."
+	as := newTestAgentServerForIdentity(t, dir)
+
+	if got := as.registerMaxRetries(); got != defaultRegisterMaxRetries {
+		t.Fatalf("expected default max retries %d, got %d", defaultRegisterMaxRetries, got)
+	}
+	if got := as.registerBackoff(); got != defaultRegisterBackoff {
+		t.Fatalf("expected default backoff %v, got %v", defaultRegisterBackoff, got)
+	}
+}
@@ -3,6 +3,7 @@
 package agent
 
 import (
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	pb "github.com/chrislusf/gleam/idl/master_rpc"
@@ -32,6 +34,19 @@ type AgentServerOption struct {
 	MemoryMB     *int64
 	CPULevel     *int
 	CleanRestart *bool
+
+	IdleTimeout        *time.Duration
+	TCPReadBuffer      *int
+	TCPWriteBuffer     *int
+	TCPKeepAlivePeriod *time.Duration
+
+	GrpcKeepaliveTime                *time.Duration
+	GrpcKeepaliveTimeout             *time.Duration
+	GrpcKeepalivePermitWithoutStream *bool
+	MaxReconnectAttempts             *int
+
+	RegisterMaxRetries *int
+	RegisterBackoff    *time.Duration
 }
 
 type AgentServer struct {
@@ -45,8 +60,17 @@ type AgentServer struct {
 	storageBackend        *LocalDatasetShardsManager
 	inMemoryChannels      *LocalDatasetShardsManagerInMemory
 	localExecutorManager  *LocalExecutorManager
+	wal                   *writeAheadLog
+
+	agentUUID                string
+	agentEpoch               uint64
+	clusterConfigVersion     uint64
+	clusterConfigVersionLock sync.Mutex
 
-	grpcConection *grpc.ClientConn
+	grpcConection     *grpc.ClientConn
+	grpcConectionLock sync.Mutex
+
+	stopped int32 // set via atomic; 0 = running, 1 = Stop has been called
 }
 
 func NewAgentServer(option *AgentServerOption) *AgentServer {
@@ -69,6 +93,7 @@ func NewAgentServer(option *AgentServerOption) *AgentServer {
 		},
 		allocatedResource:    &pb.ComputeResource{},
 		localExecutorManager: newLocalExecutorsManager(),
+		wal:                  newWriteAheadLog(*option.Dir, *option.Port),
 	}
 
 	go as.storageBackend.purgeExpiredEntries()
@@ -80,16 +105,28 @@ func NewAgentServer(option *AgentServerOption) *AgentServer {
 		panic(err)
 	}
 
+	if err := as.Register(context.Background()); err != nil {
+		panic(err)
+	}
+
 	return as
 }
 
 func (r *AgentServer) init() (err error) {
-	r.listener, err = net.Listen("tcp", *r.Option.Host+":"+strconv.Itoa(*r.Option.Port))
+	listener, err := net.Listen("tcp", *r.Option.Host+":"+strconv.Itoa(*r.Option.Port))
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	r.listener = &util.TimeoutListener{
+		Listener:         listener,
+		IdleTimeout:      r.idleTimeout(),
+		ReadBufferBytes:  intValue(r.Option.TCPReadBuffer),
+		WriteBufferBytes: intValue(r.Option.TCPWriteBuffer),
+		KeepAlivePeriod:  durationValue(r.Option.TCPKeepAlivePeriod),
+	}
+
 	fmt.Println("AgentServer starts on", *r.Option.Host+":"+strconv.Itoa(*r.Option.Port))
 
 	if *r.Option.CleanRestart {
@@ -103,6 +140,11 @@ func (r *AgentServer) init() (err error) {
 				}
 			}
 		}
+		if err := removeStaleSegments(*r.Option.Dir, *r.Option.Port); err != nil && !os.IsNotExist(err) {
+			fmt.Println("Failed to remove old WAL segments:", err)
+		}
+	} else if err := r.recoverWAL(); err != nil {
+		fmt.Println("Failed to recover WAL segments:", err)
 	}
 
 	return
@@ -117,20 +159,19 @@ func (as *AgentServer) Run() {
 		// Listen for an incoming connection.
 		conn, err := as.listener.Accept()
 		if err != nil {
+			if as.isStopped() {
+				return
+			}
 			fmt.Println("Error accepting: ", err.Error())
 			continue
 		}
-		// Handle connections in a new goroutine.
+		// Handle connections in a new goroutine. TCP options and the idle
+		// deadline are already applied by the util.TimeoutListener wrapping
+		// as.listener; long-lived streams opt out via disableIdleTimeout.
 		as.wg.Add(1)
 		go func() {
 			defer as.wg.Done()
 			defer conn.Close()
-			if err = conn.SetDeadline(time.Time{}); err != nil {
-				fmt.Printf("Failed to set timeout: %v\n", err)
-			}
-			if c, ok := conn.(*net.TCPConn); ok {
-				c.SetKeepAlive(true)
-			}
 			as.handleRequest(conn)
 		}()
 	}
@@ -138,10 +179,15 @@ func (as *AgentServer) Run() {
 
 // Stop stops handling incoming requests and waits out all ongoing requests
 func (r *AgentServer) Stop() {
+	atomic.StoreInt32(&r.stopped, 1)
 	r.listener.Close()
 	r.wg.Wait()
 }
 
+func (r *AgentServer) isStopped() bool {
+	return atomic.LoadInt32(&r.stopped) != 0
+}
+
 func (r *AgentServer) handleRequest(conn net.Conn) {
 
 	data, err := util.ReadMessage(conn)
@@ -170,14 +216,26 @@ func (as *AgentServer) handleCommandConnection(conn net.Conn,
 	command *msg.ControlMessage) *msg.ControlMessage {
 	reply := &msg.ControlMessage{}
 	if command.GetReadRequest() != nil {
+		// shard reads can legitimately stream for a long time; the
+		// control-plane idle timeout does not apply to them.
+		disableIdleTimeout(conn)
+		// NOTE: resumed reads are not wired up over RPC.
+		// command.ReadRequest has no FromSequence field in this tree — the
+		// generated msg package isn't vendored here, so there's no .proto to
+		// add it to — so fromSequence is hardcoded to 0 and every read
+		// starts from scratch. handleReadConnection/handleInMemoryReadConnection's
+		// non-zero-fromSeq resume path has no caller; recoverWAL replays
+		// through wal.RecoverFromSequence directly, from sequence 0.
+		const fromSequence = 0
 		if !command.GetIsOnDiskIO() {
-			as.handleInMemoryReadConnection(conn, *command.ReadRequest.ReaderName, *command.ReadRequest.ChannelName)
+			as.handleInMemoryReadConnection(conn, *command.ReadRequest.ReaderName, *command.ReadRequest.ChannelName, fromSequence)
 		} else {
-			as.handleReadConnection(conn, *command.ReadRequest.ReaderName, *command.ReadRequest.ChannelName)
+			as.handleReadConnection(conn, *command.ReadRequest.ReaderName, *command.ReadRequest.ChannelName, fromSequence)
 		}
 		return nil
 	}
 	if command.GetWriteRequest() != nil {
+		disableIdleTimeout(conn)
 		if !command.GetIsOnDiskIO() {
 			as.handleLocalInMemoryWriteConnection(conn, *command.WriteRequest.WriterName, *command.WriteRequest.ChannelName, int(command.GetWriteRequest().GetReaderCount()))
 		} else {
@@ -193,6 +251,9 @@ func (as *AgentServer) handleCommandConnection(conn net.Conn,
 			host := remoteAddress[:strings.LastIndex(remoteAddress, ":")]
 			command.StartRequest.Host = &host
 		}
+		// the connection stays open for as long as the started executor
+		// keeps producing output, same as a shard read.
+		disableIdleTimeout(conn)
 		reply.StartResponse = as.handleStart(conn, command.StartRequest)
 		// return nil to avoid writing the response to the connection.
 		// Currently the connection is used for reading outputs
@@ -209,3 +270,40 @@ func (as *AgentServer) handleCommandConnection(conn net.Conn,
 	}
 	return reply
 }
+
+// disableIdleTimeout opts a connection out of the listener's idle timeout,
+// for handlers that may legitimately stream for a long time.
+func disableIdleTimeout(conn net.Conn) {
+	if tc, ok := conn.(*util.TimeoutConn); ok {
+		tc.DisableDeadline()
+	}
+}
+
+// defaultIdleTimeout bounds how long an accepted connection can sit idle
+// before reads or writes on it fail with a timeout, at which point the
+// handler goroutine in Run returns and closes it. Command files and flags both leave
+// IdleTimeout unset far more often than not, and a zero value disables the
+// deadline entirely, which is exactly the "stuck peer holds a goroutine
+// forever" failure this wrapper exists to prevent.
+const defaultIdleTimeout = 2 * time.Minute
+
+func (r *AgentServer) idleTimeout() time.Duration {
+	if r.Option.IdleTimeout != nil {
+		return *r.Option.IdleTimeout
+	}
+	return defaultIdleTimeout
+}
+
+func durationValue(d *time.Duration) time.Duration {
+	if d == nil {
+		return 0
+	}
+	return *d
+}
+
+func intValue(i *int) int {
+	if i == nil {
+		return 0
+	}
+	return *i
+}
@@ -0,0 +1,314 @@
+package agent
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chrislusf/gleam/util"
+)
+
+// channelExpiry is how long a channel can go untouched before
+// purgeExpiredEntries treats it as abandoned and drops it.
+const channelExpiry = 10 * time.Minute
+
+// LocalDatasetShardsManager buffers on-disk shard channel data under dir,
+// one flat file per channel named "<channelName>-<port>.dat", so local
+// readers and writers on this agent can exchange a channel's data without
+// going through master.
+type LocalDatasetShardsManager struct {
+	dir  string
+	port int
+
+	mu       sync.Mutex
+	channels map[string]*onDiskChannel
+}
+
+type onDiskChannel struct {
+	lastActive time.Time
+}
+
+func NewLocalDatasetShardsManager(dir string, port int) *LocalDatasetShardsManager {
+	return &LocalDatasetShardsManager{
+		dir:      dir,
+		port:     port,
+		channels: make(map[string]*onDiskChannel),
+	}
+}
+
+func (m *LocalDatasetShardsManager) path(channelName string) string {
+	return filepath.Join(m.dir, fmt.Sprintf("%s-%d.dat", channelName, m.port))
+}
+
+func (m *LocalDatasetShardsManager) touch(channelName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.channels[channelName]
+	if !ok {
+		ch = &onDiskChannel{}
+		m.channels[channelName] = ch
+	}
+	ch.lastActive = time.Now()
+}
+
+// append writes one chunk to channelName's backing file.
+func (m *LocalDatasetShardsManager) append(channelName string, chunk []byte) error {
+	m.touch(channelName)
+
+	f, err := os.OpenFile(m.path(channelName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(chunk)
+	return err
+}
+
+// readAll returns everything written to channelName so far.
+func (m *LocalDatasetShardsManager) readAll(channelName string) ([]byte, error) {
+	data, err := ioutil.ReadFile(m.path(channelName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	return data, err
+}
+
+// reclaim re-registers channel files already on disk for this agent's port
+// as active, rather than letting purgeExpiredEntries sweep them up as
+// orphans before a downstream reader has had a chance to reconnect. It is
+// meant to run once, right after a restart with the same persisted agent
+// UUID confirms these files are this agent's own leftovers.
+func (m *LocalDatasetShardsManager) reclaim() error {
+	fileInfos, err := ioutil.ReadDir(m.dir)
+	if err != nil {
+		return err
+	}
+	suffix := fmt.Sprintf("-%d.dat", m.port)
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		m.touch(strings.TrimSuffix(name, suffix))
+	}
+	return nil
+}
+
+func (m *LocalDatasetShardsManager) purgeExpiredEntries() {
+	for {
+		time.Sleep(time.Minute)
+		m.mu.Lock()
+		for channelName, ch := range m.channels {
+			if time.Since(ch.lastActive) > channelExpiry {
+				delete(m.channels, channelName)
+				os.Remove(m.path(channelName))
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// LocalDatasetShardsManagerInMemory is the in-memory counterpart of
+// LocalDatasetShardsManager, for channels whose writer and reader asked for
+// IsOnDiskIO == false.
+type LocalDatasetShardsManagerInMemory struct {
+	mu       sync.Mutex
+	channels map[string]*inMemoryChannel
+}
+
+type inMemoryChannel struct {
+	data       []byte
+	lastActive time.Time
+}
+
+func NewLocalDatasetShardsManagerInMemory() *LocalDatasetShardsManagerInMemory {
+	return &LocalDatasetShardsManagerInMemory{channels: make(map[string]*inMemoryChannel)}
+}
+
+func (m *LocalDatasetShardsManagerInMemory) append(channelName string, chunk []byte) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch, ok := m.channels[channelName]
+	if !ok {
+		ch = &inMemoryChannel{}
+		m.channels[channelName] = ch
+	}
+	ch.data = append(ch.data, chunk...)
+	ch.lastActive = time.Now()
+}
+
+func (m *LocalDatasetShardsManagerInMemory) readAll(channelName string) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if ch, ok := m.channels[channelName]; ok {
+		return ch.data
+	}
+	return nil
+}
+
+func (m *LocalDatasetShardsManagerInMemory) purgeExpiredEntries() {
+	for {
+		time.Sleep(time.Minute)
+		m.mu.Lock()
+		for channelName, ch := range m.channels {
+			if time.Since(ch.lastActive) > channelExpiry {
+				delete(m.channels, channelName)
+			}
+		}
+		m.mu.Unlock()
+	}
+}
+
+// handleLocalWriteConnection receives chunks for channelName from
+// writerName over conn. Each chunk is appended to the WAL, which flushes it
+// to disk, before it is durably stored and the loop moves on to read the
+// next one — that ordering is what lets RecoverFromSequence replay a chunk
+// that storageBackend never got to persist because the agent crashed
+// between the two. readerCount is recorded so the WAL knows how many
+// AckReader calls to wait for before it can truncate the segment.
+func (as *AgentServer) handleLocalWriteConnection(conn net.Conn, writerName, channelName string, readerCount int) {
+	as.wal.SetReaderCount(channelName, readerCount, false)
+
+	var seq uint64
+	for {
+		chunk, err := util.ReadMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("agent: write connection for %s/%s ended: %v", channelName, writerName, err)
+			}
+			return
+		}
+		seq++
+		if err := as.wal.Append(channelName, writerName, seq, chunk, false); err != nil {
+			log.Printf("agent: wal append failed for %s: %v", channelName, err)
+			return
+		}
+		if err := as.storageBackend.append(channelName, chunk); err != nil {
+			log.Printf("agent: storing chunk for %s failed: %v", channelName, err)
+			return
+		}
+	}
+}
+
+// handleLocalInMemoryWriteConnection is handleLocalWriteConnection's
+// counterpart for IsOnDiskIO == false channels: every chunk still goes
+// through the WAL first, since a crash loses the in-memory copy just as
+// easily as an unflushed disk write, but the durable copy then lives in
+// inMemoryChannels instead of on disk.
+func (as *AgentServer) handleLocalInMemoryWriteConnection(conn net.Conn, writerName, channelName string, readerCount int) {
+	as.wal.SetReaderCount(channelName, readerCount, true)
+
+	var seq uint64
+	for {
+		chunk, err := util.ReadMessage(conn)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("agent: in-memory write connection for %s/%s ended: %v", channelName, writerName, err)
+			}
+			return
+		}
+		seq++
+		if err := as.wal.Append(channelName, writerName, seq, chunk, true); err != nil {
+			log.Printf("agent: wal append failed for %s: %v", channelName, err)
+			return
+		}
+		as.inMemoryChannels.append(channelName, chunk)
+	}
+}
+
+// handleReadConnection sends readerName everything stored for channelName.
+// If fromSeq is non-zero, a re-executed downstream task is resuming a read
+// instead of starting over, so only the WAL records after fromSeq are
+// replayed onto conn rather than the whole channel. Either way, once the
+// read completes, AckReader moves the channel a step closer to having its
+// WAL segment truncated.
+func (as *AgentServer) handleReadConnection(conn net.Conn, readerName, channelName string, fromSeq uint64) {
+	var err error
+	if fromSeq > 0 {
+		err = as.wal.RecoverFromSequence(channelName, fromSeq, false, func(writerName string, seq uint64, payload []byte) error {
+			_, writeErr := conn.Write(payload)
+			return writeErr
+		})
+	} else {
+		var data []byte
+		data, err = as.storageBackend.readAll(channelName)
+		if err == nil {
+			_, err = conn.Write(data)
+		}
+	}
+	if err != nil {
+		log.Printf("agent: read connection for %s/%s failed: %v", channelName, readerName, err)
+		return
+	}
+	if err := as.wal.AckReader(channelName, false); err != nil {
+		log.Printf("agent: wal checkpoint failed for %s: %v", channelName, err)
+	}
+}
+
+// handleInMemoryReadConnection is handleReadConnection's counterpart for
+// IsOnDiskIO == false channels.
+func (as *AgentServer) handleInMemoryReadConnection(conn net.Conn, readerName, channelName string, fromSeq uint64) {
+	var err error
+	if fromSeq > 0 {
+		err = as.wal.RecoverFromSequence(channelName, fromSeq, true, func(writerName string, seq uint64, payload []byte) error {
+			_, writeErr := conn.Write(payload)
+			return writeErr
+		})
+	} else {
+		_, err = conn.Write(as.inMemoryChannels.readAll(channelName))
+	}
+	if err != nil {
+		log.Printf("agent: in-memory read connection for %s/%s failed: %v", channelName, readerName, err)
+		return
+	}
+	if err := as.wal.AckReader(channelName, true); err != nil {
+		log.Printf("agent: wal checkpoint failed for %s: %v", channelName, err)
+	}
+}
+
+// recoverWAL replays any WAL segments left behind by an unclean shutdown
+// back into the backend they were written for, so that a downstream task
+// reconnecting to read channelName sees the writes that were durable before
+// the crash instead of the whole upstream stage being rescheduled. On-disk
+// and in-memory channels keep separate segment files (see
+// onDiskSegmentExt/inMemorySegmentExt), so each is replayed into the
+// matching backend rather than in-memory writes landing in storageBackend's
+// .dat files where handleInMemoryReadConnection would never look for them.
+func (as *AgentServer) recoverWAL() error {
+	onDiskChannelNames, err := segmentChannelNames(*as.Option.Dir, *as.Option.Port, false)
+	if err != nil {
+		return err
+	}
+	for _, channelName := range onDiskChannelNames {
+		channelName := channelName
+		err := as.wal.RecoverFromSequence(channelName, 0, false, func(writerName string, seq uint64, payload []byte) error {
+			return as.storageBackend.append(channelName, payload)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	inMemoryChannelNames, err := segmentChannelNames(*as.Option.Dir, *as.Option.Port, true)
+	if err != nil {
+		return err
+	}
+	for _, channelName := range inMemoryChannelNames {
+		channelName := channelName
+		err := as.wal.RecoverFromSequence(channelName, 0, true, func(writerName string, seq uint64, payload []byte) error {
+			as.inMemoryChannels.append(channelName, payload)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,306 @@
+package agent
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// recordHeaderSize is the fixed portion of a framed WAL record, before the
+// variable-length writer name and payload: writerNameLen(2) + seq(8) + payloadLen(4).
+const recordHeaderSize = 2 + 8 + 4
+
+// maxPayloadLen bounds the payloadLen read out of a record header, before
+// readRecord trusts it enough to allocate a buffer of that size. It is well
+// above any chunk this agent actually writes; its only job is to make sure a
+// torn or corrupted tail record (whose bytes land on a huge garbage length)
+// fails the size check instead of attempting a multi-gigabyte allocation
+// before the CRC ever gets a chance to reject it.
+const maxPayloadLen = 256 << 20
+
+// onDiskSegmentExt and inMemorySegmentExt distinguish a channel's segment
+// file by the IO type it was written under, so a restart's recovery scan
+// knows whether a given segment belongs in storageBackend or
+// inMemoryChannels without having to ask anything that didn't survive the
+// crash.
+const (
+	onDiskSegmentExt   = ".wal"
+	inMemorySegmentExt = ".memwal"
+)
+
+// writeAheadLog is the on-disk backing for one agent's shard writes: one
+// segment file per (channel, IO type), named "<channelName>-<port>.wal" for
+// on-disk channels and "<channelName>-<port>.memwal" for in-memory ones,
+// under dir. handleLocalWriteConnection and handleLocalInMemoryWriteConnection
+// call Append for every chunk they receive before passing it on to storage;
+// they send no acknowledgement back to the peer. RecoverFromSequence replays a channel's
+// segment on a non-clean restart; Checkpoint truncates a segment once every
+// reader recorded via SetReaderCount has called AckReader.
+type writeAheadLog struct {
+	dir  string
+	port int
+
+	mu            sync.Mutex
+	segments      map[string]*walSegment // segmentKey -> open segment
+	acks          map[string]int         // segmentKey -> readers that have checkpointed
+	readerTargets map[string]int         // segmentKey -> readers expected before truncation
+}
+
+type walSegment struct {
+	file   *os.File
+	writer *bufio.Writer
+}
+
+func newWriteAheadLog(dir string, port int) *writeAheadLog {
+	return &writeAheadLog{
+		dir:           dir,
+		port:          port,
+		segments:      make(map[string]*walSegment),
+		acks:          make(map[string]int),
+		readerTargets: make(map[string]int),
+	}
+}
+
+// segmentKey disambiguates a channel name by IO type, since the same
+// channelName can be written on-disk and in-memory under independent
+// sequence numbers and segment files.
+func segmentKey(channelName string, inMemory bool) string {
+	if inMemory {
+		return "mem:" + channelName
+	}
+	return "disk:" + channelName
+}
+
+func (w *writeAheadLog) segmentPath(channelName string, inMemory bool) string {
+	ext := onDiskSegmentExt
+	if inMemory {
+		ext = inMemorySegmentExt
+	}
+	return filepath.Join(w.dir, fmt.Sprintf("%s-%d%s", channelName, w.port, ext))
+}
+
+// Append frames and persists one (writerName, seq, payload) record for
+// channelName, flushing it to disk before returning so the caller can safely
+// acknowledge the write to the peer. inMemory must match the IO type the
+// corresponding read and recovery calls use, since it selects which segment
+// file the record lands in.
+func (w *writeAheadLog) Append(channelName, writerName string, seq uint64, payload []byte, inMemory bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seg, err := w.openSegment(channelName, inMemory)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, recordHeaderSize+len(writerName))
+	binary.BigEndian.PutUint16(header[0:2], uint16(len(writerName)))
+	copy(header[2:2+len(writerName)], writerName)
+	binary.BigEndian.PutUint64(header[2+len(writerName):10+len(writerName)], seq)
+	binary.BigEndian.PutUint32(header[10+len(writerName):14+len(writerName)], uint32(len(payload)))
+
+	crc := crc32.ChecksumIEEE(header)
+	crc = crc32.Update(crc, crc32.IEEETable, payload)
+
+	if _, err := seg.writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := seg.writer.Write(payload); err != nil {
+		return err
+	}
+	if err := binary.Write(seg.writer, binary.BigEndian, crc); err != nil {
+		return err
+	}
+	return seg.writer.Flush()
+}
+
+func (w *writeAheadLog) openSegment(channelName string, inMemory bool) (*walSegment, error) {
+	key := segmentKey(channelName, inMemory)
+	if seg, ok := w.segments[key]; ok {
+		return seg, nil
+	}
+	f, err := os.OpenFile(w.segmentPath(channelName, inMemory), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	seg := &walSegment{file: f, writer: bufio.NewWriter(f)}
+	w.segments[key] = seg
+	return seg, nil
+}
+
+// RecoverFromSequence replays the records persisted for channelName under
+// the given IO type, in order, skipping anything at or before fromSeq. It
+// stops cleanly, without error, once it runs out of records, and a torn
+// tail record (one truncated or CRC-mismatched by a crash mid-append) ends
+// replay the same way, since nothing past it was ever durable. It returns
+// early with yield's error if yield returns one.
+func (w *writeAheadLog) RecoverFromSequence(channelName string, fromSeq uint64, inMemory bool, yield func(writerName string, seq uint64, payload []byte) error) error {
+	f, err := os.Open(w.segmentPath(channelName, inMemory))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		writerName, seq, payload, err := readRecord(r)
+		if err != nil {
+			return nil
+		}
+		if seq <= fromSeq {
+			continue
+		}
+		if err := yield(writerName, seq, payload); err != nil {
+			return err
+		}
+	}
+}
+
+func readRecord(r *bufio.Reader) (writerName string, seq uint64, payload []byte, err error) {
+	nameLenBuf := make([]byte, 2)
+	if _, err = io.ReadFull(r, nameLenBuf); err != nil {
+		return
+	}
+	nameLen := binary.BigEndian.Uint16(nameLenBuf)
+
+	rest := make([]byte, int(nameLen)+8+4)
+	if _, err = io.ReadFull(r, rest); err != nil {
+		return "", 0, nil, io.ErrUnexpectedEOF
+	}
+	writerName = string(rest[:nameLen])
+	seq = binary.BigEndian.Uint64(rest[nameLen : nameLen+8])
+	payloadLen := binary.BigEndian.Uint32(rest[nameLen+8 : nameLen+12])
+
+	// payloadLen comes straight off disk and hasn't been CRC-checked yet, so
+	// a torn tail record (one a crash cut off mid-append) can hand back
+	// whatever garbage bytes happen to be there. Reject an implausible
+	// length before allocating, rather than after.
+	if payloadLen > maxPayloadLen {
+		return "", 0, nil, fmt.Errorf("wal: implausible payload length %d, torn tail record", payloadLen)
+	}
+
+	payload = make([]byte, payloadLen)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return "", 0, nil, io.ErrUnexpectedEOF
+	}
+
+	var crc uint32
+	if err = binary.Read(r, binary.BigEndian, &crc); err != nil {
+		return "", 0, nil, io.ErrUnexpectedEOF
+	}
+
+	want := crc32.ChecksumIEEE(nameLenBuf)
+	want = crc32.Update(want, crc32.IEEETable, rest)
+	want = crc32.Update(want, crc32.IEEETable, payload)
+	if want != crc {
+		return "", 0, nil, fmt.Errorf("wal: crc mismatch, torn tail record")
+	}
+
+	return writerName, seq, payload, nil
+}
+
+// SetReaderCount records how many readers channelName's writer expects, so
+// that a later AckReader call knows how many checkpoints to wait for before
+// truncating the segment. Called from the write path, where ReaderCount is
+// already available.
+func (w *writeAheadLog) SetReaderCount(channelName string, readerCount int, inMemory bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.readerTargets[segmentKey(channelName, inMemory)] = readerCount
+}
+
+// AckReader records that one reader has fully consumed channelName and
+// checkpoints against the target set by SetReaderCount. Called from the
+// read path, which does not carry ReaderCount itself.
+func (w *writeAheadLog) AckReader(channelName string, inMemory bool) error {
+	w.mu.Lock()
+	readerCount, ok := w.readerTargets[segmentKey(channelName, inMemory)]
+	w.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return w.Checkpoint(channelName, readerCount, inMemory)
+}
+
+// Checkpoint records that one of readerCount readers has fully consumed
+// channelName. Once all of them have checkpointed, the segment has nothing
+// left worth replaying and is truncated.
+func (w *writeAheadLog) Checkpoint(channelName string, readerCount int, inMemory bool) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	key := segmentKey(channelName, inMemory)
+	w.acks[key]++
+	if readerCount <= 0 || w.acks[key] < readerCount {
+		return nil
+	}
+	delete(w.acks, key)
+	delete(w.readerTargets, key)
+
+	if seg, ok := w.segments[key]; ok {
+		seg.file.Close()
+		delete(w.segments, key)
+	}
+
+	err := os.Remove(w.segmentPath(channelName, inMemory))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// removeStaleSegments deletes every WAL segment under dir for this agent's
+// port, on-disk and in-memory alike. It mirrors the existing CleanRestart
+// handling for *.dat files.
+func removeStaleSegments(dir string, port int) error {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	onDiskSuffix := fmt.Sprintf("-%d%s", port, onDiskSegmentExt)
+	inMemorySuffix := fmt.Sprintf("-%d%s", port, inMemorySegmentExt)
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if fi.IsDir() {
+			continue
+		}
+		if strings.HasSuffix(name, onDiskSuffix) || strings.HasSuffix(name, inMemorySuffix) {
+			os.Remove(filepath.Join(dir, name))
+		}
+	}
+	return nil
+}
+
+// segmentChannelNames lists the channel names that have a leftover segment
+// file of the given IO type under dir for this agent's port, so a
+// non-clean restart knows which channels to call RecoverFromSequence on and
+// which backend to replay them into.
+func segmentChannelNames(dir string, port int, inMemory bool) ([]string, error) {
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ext := onDiskSegmentExt
+	if inMemory {
+		ext = inMemorySegmentExt
+	}
+	suffix := fmt.Sprintf("-%d%s", port, ext)
+	var names []string
+	for _, fi := range fileInfos {
+		name := fi.Name()
+		if !fi.IsDir() && strings.HasSuffix(name, suffix) {
+			names = append(names, strings.TrimSuffix(name, suffix))
+		}
+	}
+	return names, nil
+}
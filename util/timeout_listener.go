@@ -0,0 +1,112 @@
+package util
+
+import (
+	"net"
+	"time"
+)
+
+// TimeoutListener wraps a net.Listener to apply TCP socket options at accept
+// time and give every accepted connection an idle timeout: each Read or
+// Write pushes the deadline forward, rather than the deadline being fixed
+// once at accept time. A long-lived connection that is still actively used
+// never trips it; one a peer has abandoned does, instead of parking a
+// handler goroutine on it indefinitely.
+type TimeoutListener struct {
+	net.Listener
+
+	IdleTimeout  time.Duration // reset on every successful Read and Write
+	ReadTimeout  time.Duration // if set, used instead of IdleTimeout for reads
+	WriteTimeout time.Duration // if set, used instead of IdleTimeout for writes
+
+	ReadBufferBytes  int
+	WriteBufferBytes int
+	KeepAlivePeriod  time.Duration
+}
+
+// Accept accepts the next connection, applies the configured TCP socket
+// options, and wraps it as a *TimeoutConn carrying an initial idle deadline.
+func (l *TimeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if l.KeepAlivePeriod > 0 {
+			tcpConn.SetKeepAlive(true)
+			tcpConn.SetKeepAlivePeriod(l.KeepAlivePeriod)
+		}
+		if l.ReadBufferBytes > 0 {
+			tcpConn.SetReadBuffer(l.ReadBufferBytes)
+		}
+		if l.WriteBufferBytes > 0 {
+			tcpConn.SetWriteBuffer(l.WriteBufferBytes)
+		}
+	}
+
+	readTimeout := l.ReadTimeout
+	if readTimeout <= 0 {
+		readTimeout = l.IdleTimeout
+	}
+	writeTimeout := l.WriteTimeout
+	if writeTimeout <= 0 {
+		writeTimeout = l.IdleTimeout
+	}
+
+	tc := &TimeoutConn{
+		Conn:         conn,
+		readTimeout:  readTimeout,
+		writeTimeout: writeTimeout,
+	}
+	tc.bumpReadDeadline()
+	tc.bumpWriteDeadline()
+	return tc, nil
+}
+
+// TimeoutConn is a net.Conn whose read and write deadlines are pushed
+// forward on every successful I/O, i.e. an idle timeout rather than a hard
+// cap on how long a single Read or Write may take.
+type TimeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	noDeadline   bool
+}
+
+func (c *TimeoutConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if err == nil {
+		c.bumpReadDeadline()
+	}
+	return n, err
+}
+
+func (c *TimeoutConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if err == nil {
+		c.bumpWriteDeadline()
+	}
+	return n, err
+}
+
+func (c *TimeoutConn) bumpReadDeadline() {
+	if c.noDeadline || c.readTimeout <= 0 {
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout))
+}
+
+func (c *TimeoutConn) bumpWriteDeadline() {
+	if c.noDeadline || c.writeTimeout <= 0 {
+		return
+	}
+	c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout))
+}
+
+// DisableDeadline turns off the idle timeout for the rest of the
+// connection's lifetime, for handlers that legitimately stream for a long
+// time, such as a shard write that may run for hours.
+func (c *TimeoutConn) DisableDeadline() error {
+	c.noDeadline = true
+	return c.Conn.SetDeadline(time.Time{})
+}
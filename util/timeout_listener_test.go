@@ -0,0 +1,80 @@
+package util
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeoutConnIdleTimeoutFailsReadOnAbandonedConnection(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	tc := &TimeoutConn{Conn: server, readTimeout: 20 * time.Millisecond}
+	tc.bumpReadDeadline()
+
+	buf := make([]byte, 1)
+	_, err := tc.Read(buf)
+	if err == nil {
+		t.Fatal("expected Read to time out on an idle connection")
+	}
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+}
+
+func TestTimeoutConnBumpsDeadlineOnActivity(t *testing.T) {
+	server, client := net.Pipe()
+	defer server.Close()
+	defer client.Close()
+
+	tc := &TimeoutConn{Conn: server, readTimeout: 50 * time.Millisecond}
+	tc.bumpReadDeadline()
+
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 5)
+		_, err := tc.Read(buf)
+		done <- err
+	}()
+
+	// Write before the idle timeout would expire: Read should succeed and
+	// bump the deadline rather than the connection having already died.
+	time.Sleep(20 * time.Millisecond)
+	if _, err := client.Write([]byte("hello")); err != nil {
+		t.Fatalf("client write failed: %v", err)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected Read to succeed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not return in time")
+	}
+}
+
+func TestTimeoutConnDisableDeadlineOptsOut(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	tc := &TimeoutConn{Conn: server, readTimeout: 10 * time.Millisecond}
+	if err := tc.DisableDeadline(); err != nil {
+		t.Fatalf("DisableDeadline failed: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		buf := make([]byte, 5)
+		_, err := tc.Read(buf)
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatalf("Read should not return on its own once the deadline is disabled, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	client.Close()
+}